@@ -0,0 +1,236 @@
+package forward
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ForwardStatus reports the live state of one container's port forwarding: its
+// configured mappings, current addresses, and the host ports actually resolved for
+// them - the same information ListForwards exposes over the HTTP API.
+type ForwardStatus struct {
+	Container     string         `json:"container"`
+	Forwards      []PortMappings `json:"forwards"`
+	IPv4Addresses []string       `json:"ipv4_addresses,omitempty"`
+	IPv6Addresses []string       `json:"ipv6_addresses,omitempty"`
+	ResolvedPorts map[string]int `json:"resolved_ports,omitempty"`
+}
+
+// SetConfigPath records the YAML file Config was loaded from, so AddForward and
+// RemoveForward can persist mutations back to it. Leave unset when there's no backing
+// file (e.g. a forwarder built from --container/--ports); persistence is then skipped.
+func (f *Forwarder) SetConfigPath(path string) {
+	f.configMu.Lock()
+	defer f.configMu.Unlock()
+	f.configPath = path
+}
+
+// AddForward adds a new port mapping for container, applies it immediately, and
+// persists the change back to the config file (if one is in use) so it survives a
+// restart. Like ForwardContainer/ReverseContainer, this operates at container
+// granularity: any of the container's existing forwards are torn down and reapplied
+// alongside the new one, since there's no API for inserting a single DNAT rule.
+func (f *Forwarder) AddForward(container string, pm PortMappings) error {
+	f.configMu.Lock()
+	defer f.configMu.Unlock()
+
+	previous := f.Config.Forwards[container]
+	hadForwards := len(previous) > 0
+
+	f.Config.Forwards[container] = append(append([]PortMappings{}, previous...), pm)
+	if _, err := f.Config.Validate(); err != nil {
+		f.Config.Forwards[container] = previous
+		return err
+	}
+
+	if hadForwards {
+		if err := f.reverseContainer(container, previous); err != nil {
+			return err
+		}
+	}
+	if err := f.ForwardContainer(container); err != nil {
+		return err
+	}
+
+	return f.persist()
+}
+
+// RemoveForward removes the port mapping publishing hostPort/protocol for container,
+// applies the change immediately, and persists it back to the config file (if one is
+// in use). Like AddForward, this tears down and reapplies the container's remaining
+// forwards rather than deleting a single DNAT rule in place.
+func (f *Forwarder) RemoveForward(container, protocol, hostPort string) error {
+	f.configMu.Lock()
+	defer f.configMu.Unlock()
+
+	existing, ok := f.Config.Forwards[container]
+	if !ok {
+		return fmt.Errorf("No port rules provided for %s", container)
+	}
+
+	removed := false
+	remaining := make([]PortMappings, 0, len(existing))
+	for _, pm := range existing {
+		if pm.Protocol == protocol {
+			if _, ok := pm.Ports[hostPort]; ok {
+				delete(pm.Ports, hostPort)
+				removed = true
+			}
+		}
+		if len(pm.Ports) > 0 {
+			remaining = append(remaining, pm)
+		}
+	}
+	if !removed {
+		return fmt.Errorf("No %s forward for host port %s on %s", protocol, hostPort, container)
+	}
+
+	if err := f.reverseContainer(container, existing); err != nil {
+		return err
+	}
+
+	if len(remaining) == 0 {
+		delete(f.Config.Forwards, container)
+		return f.persist()
+	}
+
+	f.Config.Forwards[container] = remaining
+	if err := f.ForwardContainer(container); err != nil {
+		return err
+	}
+	return f.persist()
+}
+
+// ListForwards reports the live state of every configured container.
+func (f *Forwarder) ListForwards() []ForwardStatus {
+	f.configMu.Lock()
+	containers := make([]string, 0, len(f.Config.Forwards))
+	forwards := map[string][]PortMappings{}
+	for container, pms := range f.Config.Forwards {
+		containers = append(containers, container)
+		forwards[container] = pms
+	}
+	f.configMu.Unlock()
+
+	resolved := f.ResolvedPorts()
+
+	statuses := make([]ForwardStatus, 0, len(containers))
+	for _, container := range containers {
+		ip4Addresses, ip6Addresses, _ := f.containerAddresses(container, f.ipv6Enabled(forwards[container]))
+		statuses = append(statuses, ForwardStatus{
+			Container:     container,
+			Forwards:      forwards[container],
+			IPv4Addresses: ip4Addresses,
+			IPv6Addresses: ip6Addresses,
+			ResolvedPorts: resolved[container],
+		})
+	}
+	return statuses
+}
+
+// persist writes Config back to configPath, if one was set via SetConfigPath, using a
+// temp-file-plus-rename so a reader (or a crash mid-write) never observes a partially
+// written file. Callers must hold configMu.
+func (f *Forwarder) persist() error {
+	if f.configPath == "" {
+		return nil
+	}
+
+	data, err := yaml.Marshal(f.Config)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.configPath), ".lxd-port-forward-*.yaml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.configPath)
+}
+
+// Serve runs the daemon-mode HTTP+JSON control plane on a Unix socket at socketPath,
+// exposing AddForward/RemoveForward/ListForwards so a forward can be added or removed
+// without bouncing the process. It blocks until the listener fails or is closed.
+func (f *Forwarder) Serve(socketPath string) error {
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/forwards", f.handleForwards)
+	mux.HandleFunc("/forwards/", f.handleForward)
+
+	return http.Serve(listener, mux)
+}
+
+// addForwardRequest is the JSON body POST /forwards expects
+type addForwardRequest struct {
+	Container string       `json:"container"`
+	Forward   PortMappings `json:"forward"`
+}
+
+// handleForwards serves GET /forwards (list) and POST /forwards (add)
+func (f *Forwarder) handleForwards(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, f.ListForwards())
+
+	case http.MethodPost:
+		var req addForwardRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := f.AddForward(req.Container, req.Forward); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, f.ListForwards())
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleForward serves DELETE /forwards/<container>?protocol=tcp&host_port=8080
+func (f *Forwarder) handleForward(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	container := strings.TrimPrefix(r.URL.Path, "/forwards/")
+	protocol := r.URL.Query().Get("protocol")
+	hostPort := r.URL.Query().Get("host_port")
+
+	if err := f.RemoveForward(container, protocol, hostPort); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, f.ListForwards())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
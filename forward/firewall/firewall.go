@@ -0,0 +1,56 @@
+// Package firewall abstracts the handful of operations ForwardContainer/ReverseContainer
+// need from the host's packet filter, so the backend that actually installs the rules
+// (iptables, nftables) can be swapped without touching the forwarding logic.
+package firewall
+
+import "fmt"
+
+// Family selects the IP address family a Firewall instance operates on
+type Family int
+
+const (
+	// IPv4 selects the iptables/IPv4 family
+	IPv4 Family = iota
+	// IPv6 selects the ip6tables/IPv6 family
+	IPv6
+)
+
+// Firewall is implemented by each backend capable of installing NAT rules. Rule specs
+// follow the same argument convention as github.com/coreos/go-iptables, e.g.
+// []string{"-p", "tcp", "--dport", "80", "-j", "DNAT", "--to", "10.0.0.2:80"}.
+type Firewall interface {
+	NewChain(table, chain string) error
+	DeleteChain(table, chain string) error
+	Append(table, chain string, rule ...string) error
+	Insert(table, chain string, pos int, rule ...string) error
+	Delete(table, chain string, rule ...string) error
+	Exists(table, chain string, rule ...string) (bool, error)
+	// List returns the rules currently installed in chain, in whatever native format
+	// the backend itself uses to report them - callers that need to diff against it
+	// should match loosely (e.g. substring checks) rather than assume a stable grammar.
+	List(table, chain string) ([]string, error)
+}
+
+// New constructs a Firewall for the given family, using the named backend:
+//   - "iptables" uses the iptables/ip6tables binaries via go-iptables (the default)
+//   - "nftables" talks to the kernel's nf_tables subsystem directly
+//   - "auto" prefers nftables, falling back to iptables if the kernel doesn't support it
+func New(backend string, family Family) (Firewall, error) {
+	switch backend {
+	case "", "iptables":
+		return newIPTablesFirewall(family)
+
+	case "nftables":
+		return newNFTablesFirewall(family)
+
+	case "auto":
+		fw, err := newNFTablesFirewall(family)
+		if err == nil {
+			return fw, nil
+		}
+		return newIPTablesFirewall(family)
+
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %q", backend)
+	}
+}
@@ -0,0 +1,65 @@
+package firewall
+
+import "github.com/godbus/dbus/v5"
+
+const (
+	firewalldBusName     = "org.fedoraproject.FirewallD1"
+	firewalldObjectPath  = "/org/fedoraproject/FirewallD1"
+	firewalldDirectIface = firewalldBusName + ".direct"
+)
+
+// firewalldActive reports whether firewalld is running on the system bus
+func firewalldActive() bool {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return false
+	}
+
+	var owned bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, firewalldBusName).Store(&owned)
+	if err != nil {
+		return false
+	}
+	return owned
+}
+
+// passthrough registers a raw iptables/ip6tables argument list with firewalld's
+// direct.addPassthrough interface, so it is part of firewalld's own runtime
+// configuration and gets replayed after `firewall-cmd --reload` instead of being wiped
+// out by it. (direct.passthrough, despite the name, only executes args once and isn't
+// retained across a reload - addPassthrough is the one that survives.) Errors are
+// intentionally ignored by callers - when firewalld is misbehaving we still want our
+// own iptables rules to take effect.
+func passthrough(family Family, args ...string) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+
+	ipv := "ipv4"
+	if family == IPv6 {
+		ipv = "ipv6"
+	}
+
+	obj := conn.Object(firewalldBusName, dbus.ObjectPath(firewalldObjectPath))
+	call := obj.Call(firewalldDirectIface+".addPassthrough", 0, ipv, args)
+	return call.Err
+}
+
+// removePassthrough undoes a prior passthrough registration, so a rule/chain torn down
+// at runtime also stops being replayed on the next firewalld reload.
+func removePassthrough(family Family, args ...string) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+
+	ipv := "ipv4"
+	if family == IPv6 {
+		ipv = "ipv6"
+	}
+
+	obj := conn.Object(firewalldBusName, dbus.ObjectPath(firewalldObjectPath))
+	call := obj.Call(firewalldDirectIface+".removePassthrough", 0, ipv, args)
+	return call.Err
+}
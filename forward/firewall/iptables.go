@@ -0,0 +1,101 @@
+package firewall
+
+import (
+	"strconv"
+
+	goiptables "github.com/coreos/go-iptables/iptables"
+)
+
+// iptablesFirewall implements Firewall on top of the iptables/ip6tables binaries. When
+// firewalld is running, every chain/rule change is also mirrored through its
+// direct.addPassthrough interface, so the whole forward - not just the empty chain -
+// survives a `firewall-cmd --reload`.
+type iptablesFirewall struct {
+	table     *goiptables.IPTables
+	family    Family
+	firewalld bool
+}
+
+func newIPTablesFirewall(family Family) (Firewall, error) {
+	proto := goiptables.ProtocolIPv4
+	if family == IPv6 {
+		proto = goiptables.ProtocolIPv6
+	}
+
+	table, err := goiptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, err
+	}
+
+	return &iptablesFirewall{
+		table:     table,
+		family:    family,
+		firewalld: firewalldActive(),
+	}, nil
+}
+
+func (f *iptablesFirewall) NewChain(table, chain string) error {
+	if err := f.table.NewChain(table, chain); err != nil {
+		return err
+	}
+	if f.firewalld {
+		// Best-effort: failures here are not fatal, as iptables rules still work
+		// without firewalld's cooperation.
+		passthrough(f.family, "-t", table, "-N", chain)
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) DeleteChain(table, chain string) error {
+	f.table.ClearChain(table, chain)
+	if err := f.table.DeleteChain(table, chain); err != nil {
+		return err
+	}
+	if f.firewalld {
+		removePassthrough(f.family, "-t", table, "-N", chain)
+		passthrough(f.family, "-t", table, "-X", chain)
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) Append(table, chain string, rule ...string) error {
+	if err := f.table.Append(table, chain, rule...); err != nil {
+		return err
+	}
+	if f.firewalld {
+		passthrough(f.family, append([]string{"-t", table, "-A", chain}, rule...)...)
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) Insert(table, chain string, pos int, rule ...string) error {
+	if err := f.table.Insert(table, chain, pos, rule...); err != nil {
+		return err
+	}
+	if f.firewalld {
+		passthrough(f.family, append([]string{"-t", table, "-I", chain, strconv.Itoa(pos)}, rule...)...)
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) Delete(table, chain string, rule ...string) error {
+	if err := f.table.Delete(table, chain, rule...); err != nil {
+		return err
+	}
+	if f.firewalld {
+		// The rule may have been added at position 1 via Insert (the hook jumps) or via
+		// Append (the per-port rules), so retract the addPassthrough entry for either.
+		removePassthrough(f.family, append([]string{"-t", table, "-I", chain, "1"}, rule...)...)
+		removePassthrough(f.family, append([]string{"-t", table, "-A", chain}, rule...)...)
+		passthrough(f.family, append([]string{"-t", table, "-D", chain}, rule...)...)
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) Exists(table, chain string, rule ...string) (bool, error) {
+	return f.table.Exists(table, chain, rule...)
+}
+
+func (f *iptablesFirewall) List(table, chain string) ([]string, error) {
+	return f.table.List(table, chain)
+}
@@ -0,0 +1,366 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nftablesFirewall implements Firewall directly against the kernel's nf_tables
+// subsystem. It only needs to understand the handful of rule shapes the rest of this
+// package ever generates (see getChainForwardRule/getPortForwardRule in the forward
+// package) rather than the full iptables rule grammar.
+type nftablesFirewall struct {
+	conn   *nftables.Conn
+	table  *nftables.Table
+	family Family
+}
+
+func newNFTablesFirewall(family Family) (Firewall, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, err
+	}
+
+	nftFamily := nftables.TableFamilyIPv4
+	if family == IPv6 {
+		nftFamily = nftables.TableFamilyIPv6
+	}
+
+	table := conn.AddTable(&nftables.Table{Family: nftFamily, Name: "nat"})
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("nftables not usable: %s", err)
+	}
+
+	return &nftablesFirewall{conn: conn, table: table, family: family}, nil
+}
+
+// baseChainHooks describes the base chains this package jumps into, matching the
+// PREROUTING/OUTPUT/POSTROUTING hooks the iptables backend uses
+var baseChainHooks = map[string]struct {
+	hook     *nftables.ChainHook
+	priority *nftables.ChainPriority
+}{
+	"PREROUTING":  {nftables.ChainHookPrerouting, nftables.ChainPriorityNATDest},
+	"OUTPUT":      {nftables.ChainHookOutput, nftables.ChainPriorityNATDest},
+	"POSTROUTING": {nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource},
+}
+
+func (f *nftablesFirewall) NewChain(table, chain string) error {
+	c := &nftables.Chain{Table: f.table, Name: chain}
+	if base, ok := baseChainHooks[chain]; ok {
+		c.Type = nftables.ChainTypeNAT
+		c.Hooknum = base.hook
+		c.Priority = base.priority
+	}
+	f.conn.AddChain(c)
+	return f.conn.Flush()
+}
+
+func (f *nftablesFirewall) DeleteChain(table, chain string) error {
+	c := &nftables.Chain{Table: f.table, Name: chain}
+	f.conn.FlushChain(c)
+	f.conn.DelChain(c)
+	return f.conn.Flush()
+}
+
+func (f *nftablesFirewall) Append(table, chain string, rule ...string) error {
+	exprs, err := translateRule(f.family, rule)
+	if err != nil {
+		return err
+	}
+	f.conn.AddRule(&nftables.Rule{Table: f.table, Chain: &nftables.Chain{Table: f.table, Name: chain}, Exprs: exprs})
+	return f.conn.Flush()
+}
+
+func (f *nftablesFirewall) Insert(table, chain string, pos int, rule ...string) error {
+	exprs, err := translateRule(f.family, rule)
+	if err != nil {
+		return err
+	}
+	f.conn.InsertRule(&nftables.Rule{Table: f.table, Chain: &nftables.Chain{Table: f.table, Name: chain}, Exprs: exprs})
+	return f.conn.Flush()
+}
+
+func (f *nftablesFirewall) Delete(table, chain string, rule ...string) error {
+	wanted, err := translateRule(f.family, rule)
+	if err != nil {
+		return err
+	}
+
+	existing, err := f.conn.GetRules(f.table, &nftables.Chain{Table: f.table, Name: chain})
+	if err != nil {
+		return err
+	}
+	for _, r := range existing {
+		if sameExprs(r.Exprs, wanted) {
+			if err := f.conn.DelRule(r); err != nil {
+				return err
+			}
+			return f.conn.Flush()
+		}
+	}
+	return nil
+}
+
+// List reports the rules installed in chain using this package's own internal
+// representation (Go's %#v of the expr tree) rather than iptables save-format - there is
+// no stable text grammar for nft rules the way there is for `iptables -S`.
+func (f *nftablesFirewall) List(table, chain string) ([]string, error) {
+	rules, err := f.conn.GetRules(f.table, &nftables.Chain{Table: f.table, Name: chain})
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0, len(rules))
+	for _, r := range rules {
+		lines = append(lines, fmt.Sprintf("%#v", r.Exprs))
+	}
+	return lines, nil
+}
+
+func (f *nftablesFirewall) Exists(table, chain string, rule ...string) (bool, error) {
+	wanted, err := translateRule(f.family, rule)
+	if err != nil {
+		return false, err
+	}
+
+	existing, err := f.conn.GetRules(f.table, &nftables.Chain{Table: f.table, Name: chain})
+	if err != nil {
+		return false, err
+	}
+	for _, r := range existing {
+		if sameExprs(r.Exprs, wanted) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// translateRule converts one of this package's iptables-style rule specs into the
+// equivalent nft expressions. It understands exactly the shapes produced by
+// getChainForwardRule and getPortForwardRule and returns an error for anything else.
+func translateRule(family Family, rule []string) ([]expr.Any, error) {
+	args := rule
+	var exprs []expr.Any
+	negateNext := false
+
+	for len(args) > 0 {
+		switch args[0] {
+		case "!":
+			// "! -d 127.0.0.0/8" negates the address match that follows
+			negateNext = true
+			args = args[1:]
+
+		case "-m":
+			// "-m addrtype --dst-type LOCAL"
+			if len(args) < 4 || args[1] != "addrtype" || args[2] != "--dst-type" {
+				return nil, fmt.Errorf("nftables: unsupported match %v", args[:2])
+			}
+			exprs = append(exprs, &expr.Fib{
+				Register:       1,
+				FlagPresent:    true,
+				FlagOIF:        false,
+				ResultADDRTYPE: true,
+			})
+			exprs = append(exprs, &expr.Cmp{
+				Op:       expr.CmpOpEq,
+				Register: 1,
+				Data:     binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL),
+			})
+			args = args[4:]
+
+		case "-s", "-d":
+			negate := negateNext
+			negateNext = false
+			field := args[0]
+			args = args[1:]
+			if args[0] == "!" {
+				negate = true
+				args = args[1:]
+			}
+			cidr := args[0]
+			args = args[1:]
+			e, err := matchAddress(family, field, cidr, negate)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, e...)
+
+		case "-p":
+			exprs = append(exprs, matchL4Proto(args[1])...)
+			args = args[2:]
+
+		case "--dport":
+			exprs = append(exprs, matchPort(args[1])...)
+			args = args[2:]
+
+		case "-j":
+			target := args[1]
+			rest := args[2:]
+			e, err := matchTarget(family, target, rest)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, e...)
+			args = nil
+
+		default:
+			return nil, fmt.Errorf("nftables: unsupported rule fragment %q", args[0])
+		}
+	}
+
+	return exprs, nil
+}
+
+func matchAddress(family Family, field, cidr string, negate bool) ([]expr.Any, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		ip = net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("nftables: invalid address %q", cidr)
+		}
+	}
+
+	offset := uint32(12)
+	length := uint32(4)
+	addr := ip.To4()
+	if family == IPv6 || addr == nil {
+		offset, length = 8, 16
+		addr = ip.To16()
+	}
+	if field == "-d" {
+		offset += length
+	}
+
+	op := expr.CmpOpEq
+	if negate {
+		op = expr.CmpOpNeq
+	}
+
+	data := []byte(addr)
+	if ipNet != nil {
+		data = []byte(ipNet.IP)
+	}
+
+	exprs := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+	}
+	if ipNet != nil {
+		// Mask off the host bits so the whole prefix matches, not just its first address
+		exprs = append(exprs, &expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: length, Mask: []byte(ipNet.Mask), Xor: make([]byte, length)})
+	}
+	return append(exprs, &expr.Cmp{Op: op, Register: 1, Data: data}), nil
+}
+
+func matchL4Proto(protocol string) []expr.Any {
+	num := unix.IPPROTO_TCP
+	switch protocol {
+	case "udp":
+		num = unix.IPPROTO_UDP
+	case "sctp":
+		num = unix.IPPROTO_SCTP
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(num)}},
+	}
+}
+
+func matchPort(port string) []expr.Any {
+	p, _ := strconv.Atoi(port)
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(p))},
+	}
+}
+
+func matchTarget(family Family, target string, rest []string) ([]expr.Any, error) {
+	switch target {
+	case "DNAT", "SNAT":
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("nftables: %s target missing --to/--to-source", target)
+		}
+		toAddr := rest[1]
+		ip, port, err := splitHostPort(toAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return nil, fmt.Errorf("nftables: invalid NAT address %q", ip)
+		}
+		addrData := addr.To4()
+		if family == IPv6 || addrData == nil {
+			addrData = addr.To16()
+		}
+
+		natExpr := &expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4}
+		if target == "SNAT" {
+			natExpr.Type = expr.NATTypeSourceNAT
+		}
+		if family == IPv6 {
+			natExpr.Family = unix.NFPROTO_IPV6
+		}
+
+		// The NAT expression itself only references registers; the literal
+		// address/port it translates to have to be loaded into those registers
+		// with an Immediate expression first.
+		exprs := []expr.Any{
+			&expr.Immediate{Register: 1, Data: []byte(addrData)},
+		}
+		natExpr.RegAddrMin = 1
+
+		if port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("nftables: invalid NAT port %q", port)
+			}
+			exprs = append(exprs, &expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(p))})
+			natExpr.RegProtoMin = 2
+		}
+
+		return append(exprs, natExpr), nil
+
+	case "MASQUERADE":
+		return []expr.Any{&expr.Masq{}}, nil
+
+	default:
+		// Jump to a custom chain, e.g. "-j LXD-c1-dst"
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: target}}, nil
+	}
+}
+
+func splitHostPort(addr string) (ip, port string, err error) {
+	// A bare address, e.g. an IPv6 --to-source "::1", has no port to split off
+	if net.ParseIP(addr) != nil {
+		return addr, "", nil
+	}
+	addr = strings.TrimPrefix(addr, "[")
+	if idx := strings.LastIndex(addr, "]:"); idx != -1 {
+		return addr[:idx], addr[idx+2:], nil
+	}
+	if idx := strings.LastIndex(addr, ":"); idx != -1 {
+		return addr[:idx], addr[idx+1:], nil
+	}
+	return addr, "", nil
+}
+
+func sameExprs(a, b []expr.Any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if fmt.Sprintf("%#v", a[i]) != fmt.Sprintf("%#v", b[i]) {
+			return false
+		}
+	}
+	return true
+}
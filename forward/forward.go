@@ -3,10 +3,15 @@ package forward
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/coreos/go-iptables/iptables"
+	"github.com/justinjudd/lxd-port-forward/forward/firewall"
+	"github.com/justinjudd/lxd-port-forward/forward/portallocator"
+	"github.com/justinjudd/lxd-port-forward/forward/proxy"
 	"github.com/lxc/lxd"
 	"gopkg.in/yaml.v2"
 )
@@ -15,8 +20,14 @@ import (
 type PortMappings struct {
 	// Name of the container - May be left empty in YAML config file
 	Name string `yaml:"name,omitempty"`
-	// Protocol should be "tcp" or "udp"
+	// Protocol should be "tcp", "udp", or "sctp"
 	Protocol string `yaml:"protocol"`
+	// HostIP restricts publishing to a single host bind address, e.g. "127.0.0.1" or
+	// "::1". Leave empty to publish on all addresses for every enabled family.
+	HostIP string `yaml:"host_ip,omitempty"`
+	// EnableIPv6 overrides Config.EnableIPv6 for just this container. Leave unset to
+	// inherit the global default.
+	EnableIPv6 *bool `yaml:"enable_ipv6,omitempty"`
 	// Ports is a mapping of host ports as keys to container ports as values
 	Ports map[string]int `yaml:",inline"`
 }
@@ -32,6 +43,16 @@ func NewPortMappings() PortMappings {
 // Config represents the Config File format that can be stored in YAML format
 type Config struct {
 	Forwards map[string][]PortMappings `yaml:",inline"`
+	// EnableIPv6 is the default used for any container that doesn't override it via
+	// PortMappings.EnableIPv6.
+	EnableIPv6 bool `yaml:"enable_ipv6,omitempty"`
+	// Firewall selects the backend used to install NAT rules: "iptables" (the
+	// default), "nftables", or "auto" to prefer nftables and fall back to iptables.
+	Firewall string `yaml:"firewall,omitempty"`
+	// UserlandProxy additionally relays each published port through a userland
+	// tcp/udp/sctp proxy alongside the DNAT rule, for reaching it from the host itself
+	// or from another container on the same bridge without relying on hairpin NAT.
+	UserlandProxy bool `yaml:"userland_proxy,omitempty"`
 }
 
 // NewConfig creates and returns initialized config
@@ -52,12 +73,76 @@ func LoadYAMLConfig(path string) (config Config, err error) {
 	return config, err
 }
 
+// portPair is a single resolved (or not-yet-resolved) host port to container port
+// mapping, expanded out of a PortMappings.Ports entry
+type portPair struct {
+	// hostPort is the requested host port, or 0 if any free port should be picked
+	hostPort      int
+	containerPort int
+}
+
+// expandHostPorts expands a single PortMappings.Ports entry into the concrete
+// (hostPort, containerPort) pairs it represents: hostPort "0" means "pick any free
+// port", and an inclusive "N-M" range expands into consecutive container ports
+// starting at containerPort.
+func expandHostPorts(hostPort string, containerPort int) ([]portPair, error) {
+	if !strings.Contains(hostPort, "-") {
+		port, err := strconv.Atoi(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port %s", hostPort)
+		}
+		return []portPair{{hostPort: port, containerPort: containerPort}}, nil
+	}
+
+	bounds := strings.SplitN(hostPort, "-", 2)
+	start, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port range %s", hostPort)
+	}
+	end, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port range %s", hostPort)
+	}
+	if end < start {
+		return nil, fmt.Errorf("Invalid port range %s", hostPort)
+	}
+
+	pairs := make([]portPair, 0, end-start+1)
+	for offset := 0; offset <= end-start; offset++ {
+		pairs = append(pairs, portPair{hostPort: start + offset, containerPort: containerPort + offset})
+	}
+	return pairs, nil
+}
+
+// validateHostIP makes sure a PortMappings.HostIP, if provided, is usable as a bind
+// address: it must parse, and must not be a multicast or link-local address.
+func validateHostIP(hostIP string) error {
+	if hostIP == "" {
+		return nil
+	}
+	ip := net.ParseIP(hostIP)
+	if ip == nil {
+		return fmt.Errorf("Invalid host IP %s", hostIP)
+	}
+	if ip.IsMulticast() {
+		return fmt.Errorf("Host IP %s is a multicast address", hostIP)
+	}
+	if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return fmt.Errorf("Host IP %s is a link-local address", hostIP)
+	}
+	return nil
+}
+
 // Validate checks a config for correctness. Currently provides the following checks:
-//	* For each container, makes sure an equal number of Host and Container Ports are provided
-//	* Makes sure no Host port is used more than once.
+//   - For each container, makes sure an equal number of Host and Container Ports are provided
+//   - Makes sure no Host port is used more than once for the same protocol and HostIP
+//   - Makes sure a HostIP, when provided, is a usable bind address
+//   - Makes sure a port isn't bound to both a specific HostIP and "any" HostIP at once
 func (c Config) Validate() (bool, error) {
 	// First do some sanity checks
 	hostPorts := map[string]interface{}{}
+	anyBound := map[string]bool{}
+	specificBound := map[string]bool{}
 
 	for container, portForwards := range c.Forwards {
 		for _, portForward := range portForwards {
@@ -66,19 +151,47 @@ func (c Config) Validate() (bool, error) {
 			if len(portForward.Ports) == 0 {
 				return false, fmt.Errorf("No ports provided for container %s", container)
 			}
-			for hPort := range portForward.Ports {
-				_, err := strconv.Atoi(hPort)
+
+			if err := validateHostIP(portForward.HostIP); err != nil {
+				return false, fmt.Errorf("%s for container %s", err, container)
+			}
+
+			for hPort, cPort := range portForward.Ports {
+				pairs, err := expandHostPorts(hPort, cPort)
 				if err != nil {
-					return false, fmt.Errorf("Invalid port %s provided for container %s", hPort, container)
+					return false, fmt.Errorf("%s for container %s", err, container)
 				}
 
-				// Can only forward a port from the host to one container, check to ensure no duplicate host ports
-				fullPort := portForward.Protocol + ":" + hPort
-				_, ok := hostPorts[fullPort]
-				if ok {
-					return false, fmt.Errorf("Port %s has already been mapped", fullPort)
+				for _, pair := range pairs {
+					// A dynamic ("0") port is resolved at forward-time by the port
+					// allocator, so it can never collide here.
+					if pair.hostPort == 0 {
+						continue
+					}
+					hPortStr := strconv.Itoa(pair.hostPort)
+
+					protoPort := portForward.Protocol + ":" + hPortStr
+					unspecified := portForward.HostIP == "" || net.ParseIP(portForward.HostIP).IsUnspecified()
+					if unspecified {
+						if specificBound[protoPort] {
+							return false, fmt.Errorf("Port %s is already bound to a specific host IP", protoPort)
+						}
+						anyBound[protoPort] = true
+					} else {
+						if anyBound[protoPort] {
+							return false, fmt.Errorf("Port %s is already bound to all host IPs", protoPort)
+						}
+						specificBound[protoPort] = true
+					}
+
+					// Can only forward a port from the host to one container, check to ensure no duplicate host ip:port combos
+					fullPort := portForward.Protocol + ":" + portForward.HostIP + ":" + hPortStr
+					_, ok := hostPorts[fullPort]
+					if ok {
+						return false, fmt.Errorf("Port %s has already been mapped", fullPort)
+					}
+					hostPorts[fullPort] = nil
 				}
-				hostPorts[fullPort] = nil
 				portForward.Name = container
 			}
 		}
@@ -90,6 +203,37 @@ func (c Config) Validate() (bool, error) {
 type Forwarder struct {
 	Config
 	*lxd.Client
+
+	allocator *portallocator.PortAllocator
+
+	// configMu guards Config.Forwards and configPath against concurrent AddForward,
+	// RemoveForward and ListForwards calls from the daemon-mode HTTP API. Watch's
+	// event handler and resyncLoop also take it, briefly, whenever they read
+	// Config.Forwards, so a mutation landing mid-tick is just serialized rather than
+	// racing the map.
+	configMu *sync.Mutex
+	// configPath is the YAML file Config was loaded from, if any. AddForward and
+	// RemoveForward persist back to it; it is empty when the process was started from
+	// the --container/--ports flags instead of a config file, and persistence is then
+	// skipped.
+	configPath string
+
+	// resolvedMu guards resolved, which Watch's event handler and its periodic resync
+	// goroutine may both touch concurrently. Forwarder methods use value receivers, so
+	// this has to be a pointer - a plain sync.Mutex would be copied, and copies of a
+	// mutex only ever protect themselves.
+	resolvedMu *sync.Mutex
+	// resolved tracks, per container, the host port actually chosen for each
+	// "protocol:containerPort" pair - useful once dynamic ("0") or range ports have
+	// been resolved to real ones.
+	resolved map[string]map[string]int
+	events   chan Event
+
+	// proxiesMu guards proxies, for the same reason resolvedMu guards resolved.
+	proxiesMu *sync.Mutex
+	// proxies tracks, per container, the userland proxies ForwardContainer started for
+	// it, so ReverseContainer can stop them again.
+	proxies map[string][]proxy.Proxy
 }
 
 const (
@@ -101,8 +245,35 @@ const (
 
 	// IPTable is the table that all IPTable rules should be added to
 	IPTable = "nat"
+
+	// ResyncInterval is how often Watch repairs drift for every configured forward,
+	// independent of whatever LXD events it sees
+	ResyncInterval = 5 * time.Minute
+
+	// eventBufferSize bounds how many unconsumed Events Watch will buffer before it
+	// starts dropping them rather than blocking reconciliation
+	eventBufferSize = 64
+)
+
+// EventType categorizes the events emitted on Forwarder.Events()
+type EventType int
+
+const (
+	// EventSynced reports that a container's iptables rules were successfully
+	// reconciled with its desired state
+	EventSynced EventType = iota
+	// EventSyncFailed reports that reconciling a container's rules failed
+	EventSyncFailed
 )
 
+// Event is emitted on Forwarder.Events() so daemon-mode callers can log or alert on
+// reconciliation outcomes instead of losing them inside the watch goroutine
+type Event struct {
+	Type      EventType
+	Container string
+	Err       error
+}
+
 // NewForwarder validates the provided config then creates and returns port forward client
 func NewForwarder(config Config) (*Forwarder, error) {
 	_, err := config.Validate()
@@ -116,10 +287,48 @@ func NewForwarder(config Config) (*Forwarder, error) {
 		return nil, err
 	}
 	c.Config = config
+	c.allocator = portallocator.New()
+	c.configMu = &sync.Mutex{}
+	c.resolvedMu = &sync.Mutex{}
+	c.resolved = map[string]map[string]int{}
+	c.events = make(chan Event, eventBufferSize)
+	c.proxiesMu = &sync.Mutex{}
+	c.proxies = map[string][]proxy.Proxy{}
 
 	return &c, nil
 }
 
+// ResolvedPorts returns, for each container with an active forward, the host port that
+// was actually allocated for each "protocol:containerPort" pair. This is how callers
+// find out which port a dynamic ("0") or range request resolved to.
+func (f Forwarder) ResolvedPorts() map[string]map[string]int {
+	f.resolvedMu.Lock()
+	defer f.resolvedMu.Unlock()
+
+	resolved := make(map[string]map[string]int, len(f.resolved))
+	for container, ports := range f.resolved {
+		resolved[container] = make(map[string]int, len(ports))
+		for key, port := range ports {
+			resolved[container][key] = port
+		}
+	}
+	return resolved
+}
+
+// Events returns the channel Watch reports reconciliation results on. Daemon-mode
+// callers should drain it to log or alert instead of losing errors silently.
+func (f Forwarder) Events() <-chan Event {
+	return f.events
+}
+
+// emit reports e on the Events channel without blocking if nobody is listening
+func (f Forwarder) emit(e Event) {
+	select {
+	case f.events <- e:
+	default:
+	}
+}
+
 // Forward enables forwarding for all containers and port mappings provided in the client config
 func (f Forwarder) Forward() error {
 	errs := []string{}
@@ -155,151 +364,296 @@ func (f Forwarder) Reverse() error {
 }
 
 // ForwardContainer turns on port forwarding for the provided container
-// Uses iptables to place ipv4 and ipv6 port forwarding rules
+// Uses iptables to place ipv4 and, when enabled, ip6tables port forwarding rules
 func (f Forwarder) ForwardContainer(container string) error {
 
-	_, ok := f.Config.Forwards[container]
+	portForwards, ok := f.Config.Forwards[container]
 	if !ok {
 		return fmt.Errorf("No port rules provided for %s", container)
 	}
 
-	state, err := f.ContainerState(container)
+	enableIPv6 := f.ipv6Enabled(portForwards)
+
+	ip4Addresses, ip6Addresses, err := f.containerAddresses(container, enableIPv6)
 	if err != nil {
 		return fmt.Errorf("unable to get container state for container %s: %s", container, err)
 	}
 
-	// Get list of IP addresses on the container to forward to
-	ip4Addresses := []string{}
-	ip6Addresses := []string{}
-	for name, network := range state.Network {
-		if strings.Contains(name, "eth") || strings.Contains(name, "enp") {
+	fw, err := firewall.New(f.Config.Firewall, firewall.IPv4)
+	if err != nil {
+		return err
+	}
+	if err := installChains(fw, container, IPv4); err != nil {
+		return err
+	}
 
-			// TODO: Can map interface in container to bridge being used, find standard way to find which interfaces on host bridge is tied to
+	// The ip6tables handle is only created, and its chains only installed, when IPv6
+	// forwarding is enabled for this container - containers/hosts without IPv6 never
+	// pay for it and never fail because of it.
+	var ip6fw firewall.Firewall
+	if enableIPv6 {
+		ip6fw, err = firewall.New(f.Config.Firewall, firewall.IPv6)
+		if err != nil {
+			return err
+		}
+		if err := installChains(ip6fw, container, IPv6); err != nil {
+			return err
+		}
+	}
 
-			for _, address := range network.Addresses {
-				switch address.Family {
-				case "inet":
-					ip4Addresses = append(ip4Addresses, address.Address)
+	// Set up rules within the custom chains of the actual port forwardings
+	for _, portForwards := range portForwards {
+		protocol := portForwards.Protocol
+		hostIP := portForwards.HostIP
+
+		// A HostIP scopes publishing to just the address family it belongs to; an
+		// empty HostIP publishes to "any" on every enabled family, as separate rules.
+		v4Active, v6Active := true, ip6fw != nil
+		if hostIP != "" {
+			if ip := net.ParseIP(hostIP); ip != nil && ip.To4() != nil {
+				v6Active = false
+			} else {
+				v4Active = false
+			}
+		}
 
-				case "inet6":
-					ip6Addresses = append(ip6Addresses, address.Address)
+		for hostPortSpec, containerPortBase := range portForwards.Ports {
+			pairs, err := expandHostPorts(hostPortSpec, containerPortBase)
+			if err != nil {
+				return err
+			}
+
+			for _, pair := range pairs {
+				actualHostPort, err := f.allocator.RequestPort(protocol, pair.hostPort)
+				if err != nil {
+					return err
+				}
+				hostPort := strconv.Itoa(actualHostPort)
+				containerPortStr := strconv.Itoa(pair.containerPort)
+
+				if v4Active {
+					for _, address := range ip4Addresses {
+						fw.Append(IPTable, getChain(container, Dst), getPortForwardRule(protocol, address, containerPortStr, hostPort, hostIP, IPv4, Dst)...)
+						fw.Append(IPTable, getChain(container, Src), getPortForwardRule(protocol, address, containerPortStr, hostPort, hostIP, IPv4, Src)...)
+					}
+				}
 
+				if v6Active && ip6fw != nil {
+					for _, address := range ip6Addresses {
+						ip6fw.Append(IPTable, getChain(container, Dst), getPortForwardRule(protocol, address, containerPortStr, hostPort, hostIP, IPv6, Dst)...)
+						ip6fw.Append(IPTable, getChain(container, Src), getPortForwardRule(protocol, address, containerPortStr, hostPort, hostIP, IPv6, Src)...)
+					}
 				}
+
+				if err := f.startPortProxy(container, protocol, hostIP, actualHostPort, v4Active, v6Active, ip4Addresses, ip6Addresses, pair.containerPort); err != nil {
+					return err
+				}
+
+				f.rememberResolvedPort(container, protocol, pair.containerPort, actualHostPort)
 			}
 
 		}
 
 	}
+	return nil
+}
 
-	iptable, err := iptables.New()
-	if err != nil {
-		return err
-	}
-	ip6table, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
-	if err != nil {
-		return err
-	}
+// rememberResolvedPort records the host port actually allocated for a container port, so
+// it can be reported back via ResolvedPorts and released again by ReverseContainer.
+func (f Forwarder) rememberResolvedPort(container, protocol string, containerPort, hostPort int) {
+	f.resolvedMu.Lock()
+	defer f.resolvedMu.Unlock()
 
-	// Create a new custom chain for the IPTable rules for just this container
-	customChain := getChain(container)
-	err = iptable.NewChain(IPTable, customChain)
-	if err != nil {
-		return err
+	if f.resolved[container] == nil {
+		f.resolved[container] = map[string]int{}
 	}
-	err = ip6table.NewChain(IPTable, customChain)
-	if err != nil {
-		return err
+	f.resolved[container][fmt.Sprintf("%s:%d", protocol, containerPort)] = hostPort
+}
+
+// resolvedPort returns the host port already resolved for container's
+// "protocol:containerPort" pair, if any
+func (f Forwarder) resolvedPort(container, protocol string, containerPort int) (int, bool) {
+	f.resolvedMu.Lock()
+	defer f.resolvedMu.Unlock()
+
+	port, ok := f.resolved[container][fmt.Sprintf("%s:%d", protocol, containerPort)]
+	return port, ok
+}
+
+// startPortProxy starts a userland proxy for one container port mapping, if
+// UserlandProxy is enabled and a backend address is available for at least one of the
+// active families. Shared by ForwardContainer and reconcileContainer so Watch's
+// ContainerStart path starts proxies the same way ForwardContainer does.
+func (f Forwarder) startPortProxy(container, protocol, hostIP string, hostPort int, v4Active, v6Active bool, ip4Addresses, ip6Addresses []string, containerPort int) error {
+	if !f.Config.UserlandProxy {
+		return nil
 	}
 
-	// Tell IPTables when to use our custom chain
-	err = iptable.Insert(IPTable, "PREROUTING", 1, []string{
-		"-m", "addrtype",
-		"--dst-type", "LOCAL",
-		"-j", customChain,
-	}...)
-	if err != nil {
-		return err
+	var containerIPv4, containerIPv6 string
+	if v4Active && len(ip4Addresses) > 0 {
+		containerIPv4 = ip4Addresses[0]
 	}
-	err = ip6table.Insert(IPTable, "PREROUTING", 1, []string{
-		"-m", "addrtype",
-		"--dst-type", "LOCAL",
-		"-j", customChain,
-	}...)
-	if err != nil {
-		return err
+	if v6Active && len(ip6Addresses) > 0 {
+		containerIPv6 = ip6Addresses[0]
+	}
+	if containerIPv4 == "" && containerIPv6 == "" {
+		return nil
 	}
 
-	// Set up rules within the custom chain of the actual port forwardings
-	for _, portForwards := range f.Config.Forwards[container] {
-		protocol := portForwards.Protocol
-		for hostPort, containerPort := range portForwards.Ports {
-
-			for _, address := range ip4Addresses {
-				iptable.Append(IPTable, customChain, []string{
-					//"-i", iface,
-					"-p", protocol,
-					"--dport", hostPort,
-					"-j", "DNAT",
-					"--to", fmt.Sprintf("%s:%d", address, containerPort),
-				}...)
-			}
+	// A single proxy call covers both families: when hostIP is empty it binds one
+	// dual-stack listener instead of racing two separate ones for the same hostPort.
+	return f.startProxy(container, protocol, hostIP, hostPort, containerIPv4, containerIPv6, containerPort)
+}
 
-			for _, address := range ip6Addresses {
-				ip6table.Append(IPTable, customChain, []string{
-					//"-i", iface,
-					"-p", protocol,
-					"--dport", hostPort,
-					"-j", "DNAT",
-					"--to", fmt.Sprintf("[%s]:%d", address, containerPort),
-				}...)
-			}
+// hasProxies reports whether any userland proxy is currently running for container
+func (f Forwarder) hasProxies(container string) bool {
+	f.proxiesMu.Lock()
+	defer f.proxiesMu.Unlock()
+	return len(f.proxies[container]) > 0
+}
 
+// startProxy starts a userland proxy relaying hostIP:hostPort to
+// containerIPv4/containerIPv6:containerPort for protocol, and remembers it against
+// container so ReverseContainer can stop it again. Run is started in its own goroutine;
+// it returns once Close is called, which is the expected, non-error way for it to end.
+func (f Forwarder) startProxy(container, protocol, hostIP string, hostPort int, containerIPv4, containerIPv6 string, containerPort int) error {
+	listenIP := hostIP
+	if listenIP == "" {
+		// A dual-stack "::" listener accepts both v4 and v6 client traffic, so one
+		// listener suffices even when both backend families are in play; when only
+		// an IPv4 backend is available, listening on "::" too would just mean an
+		// IPv4 client's connection arrives as a v4-mapped address, which the proxy
+		// already treats as IPv4 - but 0.0.0.0 is still preferred there so a host
+		// without IPv6 support at all doesn't fail to bind.
+		listenIP = "::"
+		if containerIPv6 == "" {
+			listenIP = "0.0.0.0"
 		}
+	}
 
+	p, err := proxy.New(protocol, listenIP, hostPort, containerIPv4, containerIPv6, containerPort)
+	if err != nil {
+		return err
 	}
+	go p.Run()
+
+	f.proxiesMu.Lock()
+	f.proxies[container] = append(f.proxies[container], p)
+	f.proxiesMu.Unlock()
 	return nil
 }
 
-// ReverseContainer removes port forwarding for the provided container
+// stopProxies stops and forgets every userland proxy ForwardContainer started for
+// container
+func (f Forwarder) stopProxies(container string) {
+	f.proxiesMu.Lock()
+	for _, p := range f.proxies[container] {
+		p.Close()
+	}
+	delete(f.proxies, container)
+	f.proxiesMu.Unlock()
+}
+
+// ReverseContainer removes port forwarding for the provided container, tearing down
+// whichever address families ForwardContainer installed for it
 func (f Forwarder) ReverseContainer(container string) error {
-	customChain := getChain(container)
-	iptable, err := iptables.New()
+	f.configMu.Lock()
+	portForwards := f.Config.Forwards[container]
+	f.configMu.Unlock()
+	return f.reverseContainer(container, portForwards)
+}
+
+// reverseContainer is ReverseContainer's implementation, taking the container's
+// configured port mappings directly instead of reading Config.Forwards itself.
+// AddForward and RemoveForward - which already hold configMu and already have the
+// slice in hand - call this instead of ReverseContainer, since configMu isn't
+// reentrant and they'd otherwise deadlock locking it a second time.
+func (f Forwarder) reverseContainer(container string, portForwards []PortMappings) error {
+	enableIPv6 := f.ipv6Enabled(portForwards)
+
+	f.stopProxies(container)
+
+	f.resolvedMu.Lock()
+	for key, hostPort := range f.resolved[container] {
+		protocol := strings.SplitN(key, ":", 2)[0]
+		f.allocator.ReleasePort(protocol, hostPort)
+	}
+	delete(f.resolved, container)
+	f.resolvedMu.Unlock()
+
+	fw, err := firewall.New(f.Config.Firewall, firewall.IPv4)
 	if err != nil {
 		return err
 	}
-	ip6table, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
-	if err != nil {
+	if err := teardownChains(fw, container, IPv4); err != nil {
 		return err
 	}
 
-	err = iptable.Delete(IPTable, "PREROUTING", []string{
-		"-m", "addrtype",
-		"--dst-type", "LOCAL",
-		"-j", customChain,
-	}...)
-	if err != nil {
-		return err
+	if enableIPv6 {
+		ip6fw, err := firewall.New(f.Config.Firewall, firewall.IPv6)
+		if err != nil {
+			return err
+		}
+		if err := teardownChains(ip6fw, container, IPv6); err != nil {
+			return err
+		}
 	}
-	err = ip6table.Delete(IPTable, "PREROUTING", []string{
-		"-m", "addrtype",
-		"--dst-type", "LOCAL",
-		"-j", customChain,
-	}...)
+
+	return nil
+}
+
+// containerAddresses returns the IPv4 and, if enableIPv6 is set, IPv6 addresses of
+// container's eth*/enp* network interfaces, as reported by LXD
+func (f Forwarder) containerAddresses(container string, enableIPv6 bool) (ip4Addresses, ip6Addresses []string, err error) {
+	state, err := f.ContainerState(container)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	iptable.ClearChain(IPTable, customChain)
-	iptable.DeleteChain(IPTable, customChain)
-	ip6table.ClearChain(IPTable, customChain)
-	ip6table.DeleteChain(IPTable, customChain)
+	for name, network := range state.Network {
+		if strings.Contains(name, "eth") || strings.Contains(name, "enp") {
 
-	return nil
+			// TODO: Can map interface in container to bridge being used, find standard way to find which interfaces on host bridge is tied to
+
+			for _, address := range network.Addresses {
+				switch address.Family {
+				case "inet":
+					ip4Addresses = append(ip4Addresses, address.Address)
+
+				case "inet6":
+					if enableIPv6 {
+						ip6Addresses = append(ip6Addresses, address.Address)
+					}
+				}
+			}
+		}
+	}
+
+	return ip4Addresses, ip6Addresses, nil
+}
+
+// ipv6Enabled resolves whether IPv6 rules should be installed for a container, letting
+// any PortMappings.EnableIPv6 override take precedence over Config.EnableIPv6
+func (f Forwarder) ipv6Enabled(portForwards []PortMappings) bool {
+	enableIPv6 := f.Config.EnableIPv6
+	for _, portForward := range portForwards {
+		if portForward.EnableIPv6 != nil {
+			enableIPv6 = *portForward.EnableIPv6
+		}
+	}
+	return enableIPv6
 }
 
-// Watch monitors LXD events and identifies when containers named in the config are stopped or started,
-// and disables or enables port forwarding respecitvely
+// Watch monitors LXD events and reconciles port forwarding for the containers named in
+// the config: a Stop event tears a container's rules down, and anything else affecting
+// a watched container (Start, a network device change, a DHCP-driven IP change) is
+// reconciled against what's currently installed rather than blindly re-applied. A
+// periodic resync repairs any drift Watch's event stream missed entirely - an external
+// `iptables -F`, a container restart the event never arrived for, and so on. Results
+// are reported on Events() rather than dropped, so daemon-mode callers can log or alert.
 func (f Forwarder) Watch() {
+	go f.resyncLoop()
+
 	handler := func(i interface{}) {
 		var container string
 		var message string
@@ -317,26 +671,55 @@ func (f Forwarder) Watch() {
 			container = tmp.(string)
 		}
 
+		f.configMu.Lock()
 		_, ok = f.Forwards[container]
+		f.configMu.Unlock()
+		if !ok {
+			return
+		}
+
+		tmp, ok = metadata["message"]
 		if ok {
-			tmp, ok := metadata["message"]
-			if ok {
-				message = tmp.(string)
-			}
-			switch message {
-			case ContainerStarted:
-				f.ForwardContainer(container)
-			case ContainerStopped:
-				f.ReverseContainer(container)
-			}
+			message = tmp.(string)
 		}
 
+		var err error
+		switch message {
+		case ContainerStopped:
+			err = f.ReverseContainer(container)
+		default:
+			err = f.reconcileContainer(container)
+		}
+		f.reportSync(container, err)
 	}
 
 	f.Monitor([]string{}, handler)
 }
 
-// getChain returns the custom IPTables chain that should be used for the rules for a container
-func getChain(container string) string {
-	return fmt.Sprintf("LXD-%s", container)
+// resyncLoop repairs drift for every configured forward on a fixed interval,
+// independent of whatever LXD events Watch's handler sees in the meantime.
+func (f Forwarder) resyncLoop() {
+	ticker := time.NewTicker(ResyncInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		f.configMu.Lock()
+		containers := make([]string, 0, len(f.Config.Forwards))
+		for container := range f.Config.Forwards {
+			containers = append(containers, container)
+		}
+		f.configMu.Unlock()
+
+		for _, container := range containers {
+			f.reportSync(container, f.reconcileContainer(container))
+		}
+	}
+}
+
+// reportSync emits the outcome of reconciling container on Events()
+func (f Forwarder) reportSync(container string, err error) {
+	if err != nil {
+		f.emit(Event{Type: EventSyncFailed, Container: container, Err: err})
+		return
+	}
+	f.emit(Event{Type: EventSynced, Container: container})
 }
@@ -1,6 +1,11 @@
 package forward
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/justinjudd/lxd-port-forward/forward/firewall"
+)
 
 // IPVersion is used to modify IPTables rules as needed for iptables vs ip6tables
 type IPVersion int
@@ -83,67 +88,184 @@ func getDestinationChainForwardRule(chain string) []string {
 	}
 }
 
-func getPortForwardRule(protocol, containerIP, containerPort, hostPort string, ipVersion IPVersion, dir Direction) []string {
+func getPortForwardRule(protocol, containerIP, containerPort, hostPort, hostIP string, ipVersion IPVersion, dir Direction) []string {
 	switch dir {
 	case Dst:
-		return getDestinationPortForwardRule(protocol, containerIP, containerPort, hostPort, ipVersion)
+		return getDestinationPortForwardRule(protocol, containerIP, containerPort, hostPort, hostIP, ipVersion)
 
 	case Src:
-		return getSourcePortForwardRule(protocol, containerIP, containerPort, ipVersion)
+		return getSourcePortForwardRule(protocol, containerIP, containerPort, hostIP, ipVersion)
 
 	default:
 		return []string{}
 	}
 }
 
-func getSourcePortForwardRule(protocol, containerIP, containerPort string, ipVersion IPVersion) []string {
+func getSourcePortForwardRule(protocol, containerIP, containerPort, hostIP string, ipVersion IPVersion) []string {
 
-	switch ipVersion {
-	case IPv4:
-		return []string{
-			"-p", protocol,
-			"-s", "127.0.0.0/8",
-			"-d", containerIP,
-			"--dport", containerPort,
-			"-j", "MASQUERADE",
+	loopback := "127.0.0.0/8"
+	if ipVersion == IPv6 {
+		loopback = "::1"
+	}
+
+	rule := []string{
+		"-p", protocol,
+		"-s", loopback,
+		"-d", containerIP,
+		"--dport", containerPort,
+	}
+
+	// A specific bind address means the published port has a single real source
+	// address to hairpin back to, so SNAT to it rather than MASQUERADE.
+	if hostIP != "" {
+		return append(rule, "-j", "SNAT", "--to-source", hostIP)
+	}
+	return append(rule, "-j", "MASQUERADE")
+}
+
+// installChains creates the destination and source custom chains for a container in the
+// given firewall backend, and wires the PREROUTING/OUTPUT/POSTROUTING jumps that route
+// traffic into them
+func installChains(fw firewall.Firewall, container string, ipVersion IPVersion) error {
+	for _, dir := range []Direction{Dst, Src} {
+		chain := getChain(container, dir)
+		if err := fw.NewChain(IPTable, chain); err != nil {
+			return err
 		}
 
-	case IPv6:
-		return []string{
-			"-p", protocol,
-			"-s", "::1",
-			"-d", containerIP,
-			"--dport", containerPort,
-			"-j", "MASQUERADE",
+		hook := "PREROUTING"
+		if dir == Src {
+			hook = "POSTROUTING"
+		}
+		if err := ensureBaseChain(fw, hook); err != nil {
+			return err
 		}
 
-	default:
-		return []string{}
+		rule := getChainForwardRule(container, ipVersion, dir)
+		if err := fw.Insert(IPTable, hook, 1, rule...); err != nil {
+			return err
+		}
+		if dir == Dst {
+			// Also catch traffic the host itself originates, e.g. curl'ing a published
+			// port on localhost.
+			if err := ensureBaseChain(fw, "OUTPUT"); err != nil {
+				return err
+			}
+			if err := fw.Insert(IPTable, "OUTPUT", 1, rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ensureBaseChain creates one of the PREROUTING/OUTPUT/POSTROUTING base chains if the
+// firewall backend doesn't already have it. iptables' nat table always has these built
+// in, so there this is a no-op beyond the "already exists" error it swallows; nftables
+// starts a bare custom table with none of them, so there this is what actually wires the
+// hook into the kernel's NAT pipeline.
+func ensureBaseChain(fw firewall.Firewall, chain string) error {
+	if err := fw.NewChain(IPTable, chain); err != nil && !isAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
 
+// teardownChains removes whatever installChains set up for a container in the given
+// firewall backend
+func teardownChains(fw firewall.Firewall, container string, ipVersion IPVersion) error {
+	for _, dir := range []Direction{Dst, Src} {
+		chain := getChain(container, dir)
+		rule := getChainForwardRule(container, ipVersion, dir)
+
+		hook := "PREROUTING"
+		if dir == Src {
+			hook = "POSTROUTING"
+		}
+		if err := fw.Delete(IPTable, hook, rule...); err != nil {
+			return err
+		}
+		if dir == Dst {
+			if err := fw.Delete(IPTable, "OUTPUT", rule...); err != nil {
+				return err
+			}
+		}
+
+		fw.DeleteChain(IPTable, chain)
+	}
+	return nil
+}
+
+// ensureChains is the idempotent counterpart to installChains: it only creates the
+// chain or inserts a hook rule when it isn't already there, so it is safe to call
+// repeatedly against a container whose rules are already (partially) installed
+func ensureChains(fw firewall.Firewall, container string, ipVersion IPVersion) error {
+	for _, dir := range []Direction{Dst, Src} {
+		chain := getChain(container, dir)
+		if err := fw.NewChain(IPTable, chain); err != nil && !isAlreadyExists(err) {
+			return err
+		}
+
+		hook := "PREROUTING"
+		if dir == Src {
+			hook = "POSTROUTING"
+		}
+		if err := ensureBaseChain(fw, hook); err != nil {
+			return err
+		}
+
+		rule := getChainForwardRule(container, ipVersion, dir)
+		if err := ensureRule(fw, hook, rule); err != nil {
+			return err
+		}
+		if dir == Dst {
+			if err := ensureBaseChain(fw, "OUTPUT"); err != nil {
+				return err
+			}
+			if err := ensureRule(fw, "OUTPUT", rule); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
+
+func ensureRule(fw firewall.Firewall, chain string, rule []string) error {
+	exists, err := fw.Exists(IPTable, chain, rule...)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	return fw.Insert(IPTable, chain, 1, rule...)
+}
 
+// isAlreadyExists reports whether err looks like the "chain/rule already exists" error
+// iptables/nftables return, which reconciliation is expected to run into and ignore
+func isAlreadyExists(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "exist")
 }
 
-func getDestinationPortForwardRule(protocol, containerIP, containerPort, hostPort string, ipVersion IPVersion) []string {
+func getDestinationPortForwardRule(protocol, containerIP, containerPort, hostPort, hostIP string, ipVersion IPVersion) []string {
+
+	rule := []string{}
+	if hostIP != "" {
+		rule = append(rule, "-d", hostIP)
+	}
+	rule = append(rule,
+		//"-i", iface,
+		"-p", protocol,
+		"--dport", hostPort,
+		"-j", "DNAT",
+	)
 
 	switch ipVersion {
 	case IPv4:
-		return []string{
-			//"-i", iface,
-			"-p", protocol,
-			"--dport", hostPort,
-			"-j", "DNAT",
-			"--to", fmt.Sprintf("%s:%s", containerIP, containerPort),
-		}
+		return append(rule, "--to", fmt.Sprintf("%s:%s", containerIP, containerPort))
 
 	case IPv6:
-		return []string{
-			//"-i", iface,
-			"-p", protocol,
-			"--dport", hostPort,
-			"-j", "DNAT",
-			"--to", fmt.Sprintf("[%s]:%s", containerIP, containerPort),
-		}
+		return append(rule, "--to", fmt.Sprintf("[%s]:%s", containerIP, containerPort))
 
 	default:
 		return []string{}
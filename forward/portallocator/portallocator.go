@@ -0,0 +1,95 @@
+// Package portallocator hands out host ports for port forwarding rules, modeled after
+// libnetwork's allocator: callers can request a specific port, or 0 to have the
+// allocator pick any free port in the ephemeral range.
+package portallocator
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	// DefaultRangeStart is the first port probed when a caller requests a dynamic port
+	DefaultRangeStart = 32768
+	// DefaultRangeEnd is the last port probed when a caller requests a dynamic port
+	DefaultRangeEnd = 60999
+)
+
+// PortAllocator tracks host ports that have been handed out per protocol, so they can
+// be released again once a forward is torn down
+type PortAllocator struct {
+	mu        sync.Mutex
+	allocated map[string]map[int]bool
+}
+
+// New returns an initialized PortAllocator
+func New() *PortAllocator {
+	return &PortAllocator{
+		allocated: map[string]map[int]bool{},
+	}
+}
+
+// RequestPort allocates port for protocol ("tcp" or "udp"), or, if port is 0, probes the
+// ephemeral range for any free port. It returns the port that was actually allocated.
+func (p *PortAllocator) RequestPort(protocol string, port int) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.allocated[protocol] == nil {
+		p.allocated[protocol] = map[int]bool{}
+	}
+
+	if port != 0 {
+		if p.allocated[protocol][port] {
+			return 0, fmt.Errorf("port %d/%s has already been allocated", port, protocol)
+		}
+		if !isFree(protocol, port) {
+			return 0, fmt.Errorf("port %d/%s is not available", port, protocol)
+		}
+		p.allocated[protocol][port] = true
+		return port, nil
+	}
+
+	for candidate := DefaultRangeStart; candidate <= DefaultRangeEnd; candidate++ {
+		if p.allocated[protocol][candidate] {
+			continue
+		}
+		if !isFree(protocol, candidate) {
+			continue
+		}
+		p.allocated[protocol][candidate] = true
+		return candidate, nil
+	}
+	return 0, fmt.Errorf("no free port available for %s in range %d-%d", protocol, DefaultRangeStart, DefaultRangeEnd)
+}
+
+// ReleasePort returns a previously allocated port so that it may be handed out again
+func (p *PortAllocator) ReleasePort(protocol string, port int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.allocated[protocol], port)
+}
+
+// isFree probes whether port is currently free for protocol by briefly binding to it
+func isFree(protocol string, port int) bool {
+	addr := fmt.Sprintf(":%d", port)
+
+	switch protocol {
+	case "udp":
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+
+	default:
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return false
+		}
+		ln.Close()
+		return true
+	}
+}
@@ -0,0 +1,81 @@
+// Package proxy implements userland TCP/UDP/SCTP relays for published ports, for the
+// cases plain DNAT can't serve on its own: reaching a published port from the host
+// itself, or from another container on the same bridge, requires the traffic to
+// hairpin back through the host's own address, which NAT alone handles inconsistently
+// across kernels. This is the same problem docker's docker-proxy exists to solve.
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/ishidawataru/sctp"
+)
+
+// Proxy forwards traffic received on a host address to a single container address for
+// the lifetime of a published port
+type Proxy interface {
+	// Run blocks, accepting and forwarding connections/datagrams until Close is called
+	Run() error
+	// Close stops accepting new traffic and tears down any state Run built up
+	Close() error
+}
+
+// New constructs a Proxy for protocol ("tcp", "udp", or "sctp") that listens on
+// hostIP:hostPort and forwards to containerIPv4/containerIPv6:containerPort. Either
+// container address may be empty, but not both. When both are set, New binds a single
+// dual-stack listener (hostIP must then be "" or "::", i.e. publish to "any") and relays each
+// client to whichever container address matches its own IP family - this is what lets
+// a single hostPort serve an IPv4 and an IPv6 backend at once instead of two listeners
+// racing to bind the same port.
+func New(protocol, hostIP string, hostPort int, containerIPv4, containerIPv6 string, containerPort int) (Proxy, error) {
+	if containerIPv4 == "" && containerIPv6 == "" {
+		return nil, fmt.Errorf("proxy: no container address given")
+	}
+
+	switch protocol {
+	case "tcp":
+		return newTCPProxy(hostIP, hostPort, containerIPv4, containerIPv6, containerPort)
+
+	case "udp":
+		return newUDPProxy(hostIP, hostPort, containerIPv4, containerIPv6, containerPort)
+
+	case "sctp":
+		return newSCTPProxy(hostIP, hostPort, containerIPv4, containerIPv6, containerPort)
+
+	default:
+		return nil, fmt.Errorf("proxy: unsupported protocol %q", protocol)
+	}
+}
+
+// isIPv4 reports whether addr belongs to the IPv4 family, so a dual-stack listener can
+// tell which of two family-specific backend addresses to relay a client to
+func isIPv4(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.To4() != nil
+	case *net.UDPAddr:
+		return a.IP.To4() != nil
+	case *sctp.SCTPAddr:
+		return len(a.IPAddrs) == 0 || a.IPAddrs[0].IP.To4() != nil
+	default:
+		return true
+	}
+}
+
+// pipe copies data in both directions between client and backend, returning once both
+// directions have finished (one side closing ends the other via io.Copy returning)
+func pipe(client, backend net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, backend)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
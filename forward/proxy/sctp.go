@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/ishidawataru/sctp"
+)
+
+// sctpProxy mirrors tcpProxy, but over SCTP associations via
+// github.com/ishidawataru/sctp, since the standard library has no SCTP support. When
+// both ipv4Addr and ipv6Addr are set, the listener is dual-stack and each association
+// is relayed to whichever one matches the client's own address family.
+type sctpProxy struct {
+	listener *sctp.SCTPListener
+	ipv4Addr *sctp.SCTPAddr
+	ipv6Addr *sctp.SCTPAddr
+}
+
+func newSCTPProxy(hostIP string, hostPort int, containerIPv4, containerIPv6 string, containerPort int) (Proxy, error) {
+	hostAddr, err := sctp.ResolveSCTPAddr("sctp", net.JoinHostPort(hostIP, strconv.Itoa(hostPort)))
+	if err != nil {
+		return nil, err
+	}
+	listener, err := sctp.ListenSCTP("sctp", hostAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &sctpProxy{listener: listener}
+	if containerIPv4 != "" {
+		p.ipv4Addr, err = sctp.ResolveSCTPAddr("sctp", net.JoinHostPort(containerIPv4, strconv.Itoa(containerPort)))
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if containerIPv6 != "" {
+		p.ipv6Addr, err = sctp.ResolveSCTPAddr("sctp", net.JoinHostPort(containerIPv6, strconv.Itoa(containerPort)))
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func (p *sctpProxy) Run() error {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.forward(client)
+	}
+}
+
+func (p *sctpProxy) forward(client net.Conn) {
+	defer client.Close()
+
+	backendAddr := p.backendFor(client.RemoteAddr())
+	if backendAddr == nil {
+		return
+	}
+
+	backend, err := sctp.DialSCTP("sctp", nil, backendAddr)
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+
+	pipe(client, backend)
+}
+
+// backendFor picks the container address matching remote's IP family, falling back to
+// whichever address is configured if only one is
+func (p *sctpProxy) backendFor(remote net.Addr) *sctp.SCTPAddr {
+	if isIPv4(remote) {
+		if p.ipv4Addr != nil {
+			return p.ipv4Addr
+		}
+		return p.ipv6Addr
+	}
+	if p.ipv6Addr != nil {
+		return p.ipv6Addr
+	}
+	return p.ipv4Addr
+}
+
+func (p *sctpProxy) Close() error {
+	return p.listener.Close()
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import "net"
+
+// tcpProxy accepts TCP connections on a host listener and relays each one to a
+// container address, copying bytes in both directions until either side closes. When
+// both ipv4Addr and ipv6Addr are set, the listener is dual-stack and each connection is
+// relayed to whichever one matches the client's own address family.
+type tcpProxy struct {
+	listener *net.TCPListener
+	ipv4Addr *net.TCPAddr
+	ipv6Addr *net.TCPAddr
+}
+
+func newTCPProxy(hostIP string, hostPort int, containerIPv4, containerIPv6 string, containerPort int) (Proxy, error) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(hostIP), Port: hostPort})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &tcpProxy{listener: listener}
+	if containerIPv4 != "" {
+		p.ipv4Addr = &net.TCPAddr{IP: net.ParseIP(containerIPv4), Port: containerPort}
+	}
+	if containerIPv6 != "" {
+		p.ipv6Addr = &net.TCPAddr{IP: net.ParseIP(containerIPv6), Port: containerPort}
+	}
+	return p, nil
+}
+
+func (p *tcpProxy) Run() error {
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.forward(client)
+	}
+}
+
+func (p *tcpProxy) forward(client net.Conn) {
+	defer client.Close()
+
+	backendAddr := p.backendFor(client.RemoteAddr())
+	if backendAddr == nil {
+		return
+	}
+
+	backend, err := net.DialTCP("tcp", nil, backendAddr)
+	if err != nil {
+		return
+	}
+	defer backend.Close()
+
+	pipe(client, backend)
+}
+
+// backendFor picks the container address matching remote's IP family, falling back to
+// whichever address is configured if only one is
+func (p *tcpProxy) backendFor(remote net.Addr) *net.TCPAddr {
+	if isIPv4(remote) {
+		if p.ipv4Addr != nil {
+			return p.ipv4Addr
+		}
+		return p.ipv6Addr
+	}
+	if p.ipv6Addr != nil {
+		return p.ipv6Addr
+	}
+	return p.ipv4Addr
+}
+
+func (p *tcpProxy) Close() error {
+	return p.listener.Close()
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpSessionIdleTimeout is how long a udpProxy keeps a per-client session open without
+// any reply traffic before tearing it down
+const udpSessionIdleTimeout = 2 * time.Minute
+
+// udpProxy relays UDP datagrams between a host listener and a container address,
+// keeping one backend socket per source address seen on the host listener so replies
+// route back to whichever client sent them. When both ipv4Addr and ipv6Addr are set,
+// the listener is dual-stack and each client's session dials whichever one matches its
+// own address family.
+type udpProxy struct {
+	listener *net.UDPConn
+	ipv4Addr *net.UDPAddr
+	ipv6Addr *net.UDPAddr
+
+	mu       sync.Mutex
+	sessions map[string]*net.UDPConn
+}
+
+func newUDPProxy(hostIP string, hostPort int, containerIPv4, containerIPv6 string, containerPort int) (Proxy, error) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(hostIP), Port: hostPort})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &udpProxy{listener: listener, sessions: map[string]*net.UDPConn{}}
+	if containerIPv4 != "" {
+		p.ipv4Addr = &net.UDPAddr{IP: net.ParseIP(containerIPv4), Port: containerPort}
+	}
+	if containerIPv6 != "" {
+		p.ipv6Addr = &net.UDPAddr{IP: net.ParseIP(containerIPv6), Port: containerPort}
+	}
+	return p, nil
+}
+
+func (p *udpProxy) Run() error {
+	buf := make([]byte, 65535)
+	for {
+		n, clientAddr, err := p.listener.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+
+		session, err := p.sessionFor(clientAddr)
+		if err != nil {
+			continue
+		}
+		session.Write(buf[:n])
+	}
+}
+
+// sessionFor returns the backend socket relaying traffic for clientAddr, dialing a new
+// one and starting its reply relay goroutine the first time clientAddr is seen
+func (p *udpProxy) sessionFor(clientAddr *net.UDPAddr) (*net.UDPConn, error) {
+	key := clientAddr.String()
+
+	p.mu.Lock()
+	session, ok := p.sessions[key]
+	p.mu.Unlock()
+	if ok {
+		return session, nil
+	}
+
+	backendAddr := p.backendFor(clientAddr)
+	if backendAddr == nil {
+		return nil, fmt.Errorf("proxy: no backend for client %s", clientAddr)
+	}
+
+	backend, err := net.DialUDP("udp", nil, backendAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.sessions[key] = backend
+	p.mu.Unlock()
+
+	go p.relayReplies(clientAddr, backend)
+	return backend, nil
+}
+
+// backendFor picks the container address matching remote's IP family, falling back to
+// whichever address is configured if only one is
+func (p *udpProxy) backendFor(remote net.Addr) *net.UDPAddr {
+	if isIPv4(remote) {
+		if p.ipv4Addr != nil {
+			return p.ipv4Addr
+		}
+		return p.ipv6Addr
+	}
+	if p.ipv6Addr != nil {
+		return p.ipv6Addr
+	}
+	return p.ipv4Addr
+}
+
+// relayReplies copies datagrams the backend sends back to the original client,
+// retiring the session once it's been idle past udpSessionIdleTimeout
+func (p *udpProxy) relayReplies(clientAddr *net.UDPAddr, backend *net.UDPConn) {
+	key := clientAddr.String()
+	buf := make([]byte, 65535)
+	for {
+		backend.SetReadDeadline(time.Now().Add(udpSessionIdleTimeout))
+		n, err := backend.Read(buf)
+		if err != nil {
+			p.mu.Lock()
+			delete(p.sessions, key)
+			p.mu.Unlock()
+			backend.Close()
+			return
+		}
+		p.listener.WriteToUDP(buf[:n], clientAddr)
+	}
+}
+
+func (p *udpProxy) Close() error {
+	p.mu.Lock()
+	for key, session := range p.sessions {
+		session.Close()
+		delete(p.sessions, key)
+	}
+	p.mu.Unlock()
+
+	return p.listener.Close()
+}
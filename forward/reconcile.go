@@ -0,0 +1,224 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/justinjudd/lxd-port-forward/forward/firewall"
+)
+
+// reconcileContainer recomputes the desired iptables state for container and applies
+// only the delta against what's currently installed, using ensureChains/ensureRule
+// rather than blindly re-adding rules. This is what Watch calls for every relevant
+// event and for each periodic resync tick, so it must be safe to call repeatedly
+// against a container whose rules are already (partially) installed.
+func (f Forwarder) reconcileContainer(container string) error {
+	f.configMu.Lock()
+	portForwards, ok := f.Config.Forwards[container]
+	f.configMu.Unlock()
+	if !ok {
+		return fmt.Errorf("No port rules provided for %s", container)
+	}
+
+	enableIPv6 := f.ipv6Enabled(portForwards)
+
+	ip4Addresses, ip6Addresses, err := f.containerAddresses(container, enableIPv6)
+	if err != nil {
+		// Most likely the container is stopped; there's no state left to reconcile
+		// against, so tear down whatever rules it still has and let the next Start
+		// event re-add them.
+		return f.reverseContainer(container, portForwards)
+	}
+
+	// A Start event lands here, not in ForwardContainer, so this is also where a
+	// userland proxy stopped by the preceding Stop needs to come back; only do it
+	// once per gap, not on every resync tick that finds the rules already in place.
+	startProxies := f.Config.UserlandProxy && !f.hasProxies(container)
+
+	fw, err := firewall.New(f.Config.Firewall, firewall.IPv4)
+	if err != nil {
+		return err
+	}
+	if err := ensureChains(fw, container, IPv4); err != nil {
+		return err
+	}
+
+	var ip6fw firewall.Firewall
+	if enableIPv6 {
+		ip6fw, err = firewall.New(f.Config.Firewall, firewall.IPv6)
+		if err != nil {
+			return err
+		}
+		if err := ensureChains(ip6fw, container, IPv6); err != nil {
+			return err
+		}
+	}
+
+	for _, portForward := range portForwards {
+		protocol := portForward.Protocol
+		hostIP := portForward.HostIP
+
+		v4Active, v6Active := true, ip6fw != nil
+		if hostIP != "" {
+			if ip := net.ParseIP(hostIP); ip != nil && ip.To4() != nil {
+				v6Active = false
+			} else {
+				v4Active = false
+			}
+		}
+
+		for hostPortSpec, containerPortBase := range portForward.Ports {
+			pairs, err := expandHostPorts(hostPortSpec, containerPortBase)
+			if err != nil {
+				return err
+			}
+
+			for _, pair := range pairs {
+				containerPortStr := strconv.Itoa(pair.containerPort)
+
+				// Reuse whatever host port a previous forward/reconcile already
+				// resolved this container port to, rather than asking the allocator
+				// again: re-requesting an already-bound explicit port would error,
+				// and re-requesting "0" would churn to a new port on every resync.
+				actualHostPort, known := f.resolvedPort(container, protocol, pair.containerPort)
+				if !known {
+					actualHostPort, err = f.allocator.RequestPort(protocol, pair.hostPort)
+					if err != nil {
+						return err
+					}
+					f.rememberResolvedPort(container, protocol, pair.containerPort, actualHostPort)
+				}
+				hostPort := strconv.Itoa(actualHostPort)
+
+				if v4Active {
+					if err := pruneStaleRules(fw, getChain(container, Dst), containerPortStr, ip4Addresses); err != nil {
+						return err
+					}
+					for _, address := range ip4Addresses {
+						if err := ensureRule(fw, getChain(container, Dst), getPortForwardRule(protocol, address, containerPortStr, hostPort, hostIP, IPv4, Dst)); err != nil {
+							return err
+						}
+						if err := ensureRule(fw, getChain(container, Src), getPortForwardRule(protocol, address, containerPortStr, hostPort, hostIP, IPv4, Src)); err != nil {
+							return err
+						}
+					}
+				}
+
+				if v6Active && ip6fw != nil {
+					if err := pruneStaleRules(ip6fw, getChain(container, Dst), containerPortStr, ip6Addresses); err != nil {
+						return err
+					}
+					for _, address := range ip6Addresses {
+						if err := ensureRule(ip6fw, getChain(container, Dst), getPortForwardRule(protocol, address, containerPortStr, hostPort, hostIP, IPv6, Dst)); err != nil {
+							return err
+						}
+						if err := ensureRule(ip6fw, getChain(container, Src), getPortForwardRule(protocol, address, containerPortStr, hostPort, hostIP, IPv6, Src)); err != nil {
+							return err
+						}
+					}
+				}
+
+				if startProxies {
+					if err := f.startPortProxy(container, protocol, hostIP, actualHostPort, v4Active, v6Active && ip6fw != nil, ip4Addresses, ip6Addresses, pair.containerPort); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// pruneStaleRules removes DNAT rules for containerPort in chain that don't target one
+// of validAddresses - the container's IP changing (a DHCP renewal, or a restart onto a
+// different bridge) is the main reason reconciliation ever needs to delete a rule
+// rather than just add a missing one. Matching is a field-by-field check against the
+// backend's native rule listing rather than exact rule equality, since backends don't
+// agree on a stable text grammar for rules (see Firewall.List); only rules that look
+// like the iptables backend's own `-A chain ...` output can be translated back into a
+// Delete call, so other backends are left to a full chain teardown/recreate instead.
+func pruneStaleRules(fw firewall.Firewall, chain, containerPort string, validAddresses []string) error {
+	rules, err := fw.List(IPTable, chain)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if !ruleTargetsPort(rule, containerPort) {
+			continue
+		}
+
+		stale := true
+		for _, address := range validAddresses {
+			if ruleTargetsAddress(rule, address) {
+				stale = false
+				break
+			}
+		}
+		if !stale {
+			continue
+		}
+
+		fields := strings.Fields(rule)
+		for i, field := range fields {
+			if field == "-A" && i+2 <= len(fields) {
+				fw.Delete(IPTable, chain, fields[i+2:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// ruleTargetsPort reports whether one of rule's whitespace-separated fields names port
+// as a delimited token - either on its own (a --dport value) or as the port half of a
+// "--to ip:port"/"--to [ip6]:port" destination - rather than matching it as a raw
+// substring, which would also match port "80" inside an unrelated host port like "8080"
+// or the trailing hex group of an IPv6 address
+func ruleTargetsPort(rule, port string) bool {
+	for _, field := range strings.Fields(rule) {
+		if field == port {
+			return true
+		}
+		if host, fieldPort, ok := splitHostPortField(field); ok && host != "" && fieldPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleTargetsAddress reports whether one of rule's fields names address as a delimited
+// token, the same way ruleTargetsPort does for ports
+func ruleTargetsAddress(rule, address string) bool {
+	for _, field := range strings.Fields(rule) {
+		if field == address {
+			return true
+		}
+		if host, _, ok := splitHostPortField(field); ok && host == address {
+			return true
+		}
+	}
+	return false
+}
+
+// splitHostPortField splits a field that looks like an iptables "--to" destination -
+// "ip:port" or "[ip6]:port" - into its host and port halves. ok is false for a field
+// that isn't in either of those shapes, notably a bare IPv6 address, which contains
+// colons but no port.
+func splitHostPortField(field string) (host, port string, ok bool) {
+	if strings.HasPrefix(field, "[") {
+		end := strings.Index(field, "]:")
+		if end == -1 {
+			return "", "", false
+		}
+		return field[1:end], field[end+2:], true
+	}
+	if strings.Count(field, ":") == 1 {
+		idx := strings.IndexByte(field, ':')
+		return field[:idx], field[idx+1:], true
+	}
+	return "", "", false
+}
@@ -10,11 +10,15 @@ import (
 )
 
 var (
-	daemonize  bool
-	enable     bool
-	container  string
-	portList   string
-	configFile string
+	daemonize       bool
+	enable          bool
+	enableIPv6      bool
+	firewallBackend string
+	userlandProxy   bool
+	apiSocket       string
+	container       string
+	portList        string
+	configFile      string
 )
 
 func main() {
@@ -22,13 +26,21 @@ func main() {
 	flag.BoolVar(&daemonize, "daemon", false, "Run in daemon mode")
 	flag.BoolVar(&enable, "enable", true, "Enable port forwarding if true")
 	flag.StringVar(&container, "container", "", "Name of container to forward ports to. Expects --ports to be provided.")
-	flag.StringVar(&portList, "ports", "", "Ports to forward and to forward to in the following format protocol://HostPort1:ContainerPort1,HostPort2:ContainerPort2. Expects --container to be provided.")
+	flag.StringVar(&portList, "ports", "", "Ports to forward and to forward to in the following format protocol://HostPort1:ContainerPort1,HostPort2:ContainerPort2, optionally prefixing each host port with a bind address, e.g. protocol://127.0.0.1:HostPort1:ContainerPort1. Expects --container to be provided.")
 	flag.StringVar(&configFile, "config", "config.yaml", "Port Forwarding config file in YAML format; default option for container and port mappings")
+	flag.BoolVar(&enableIPv6, "enable-ipv6", true, "Install ip6tables rules alongside iptables rules if true")
+	flag.StringVar(&firewallBackend, "firewall", "iptables", "Firewall backend to use: iptables, nftables, or auto")
+	flag.BoolVar(&userlandProxy, "userland-proxy", false, "Also relay published ports through a userland tcp/udp/sctp proxy, for reaching them from the host or from another container without relying on hairpin NAT")
+	flag.StringVar(&apiSocket, "api-socket", "", "Path to a Unix socket serving the daemon-mode HTTP API for adding/removing forwards at runtime. Disabled if empty; only used with --daemon.")
 
 	flag.Parse()
 
 	config := forward.NewConfig()
+	config.EnableIPv6 = enableIPv6
+	config.Firewall = firewallBackend
+	config.UserlandProxy = userlandProxy
 
+	fromConfigFile := false
 	if len(container) > 0 || len(portList) > 0 {
 		if len(container) == 0 {
 			fmt.Println("Container must be provided if ports are provided")
@@ -47,25 +59,29 @@ func main() {
 			fmt.Println("No ports provided")
 			return
 		}
+		// Entries with different bind addresses go into separate PortMappings, since a
+		// PortMappings carries a single HostIP for all of its ports
+		byHostIP := map[string]forward.PortMappings{}
+		hostIPs := []string{}
 		for _, ports := range strings.Split(portList, ",") {
-			split := strings.Split(ports, ":")
-			if len(split) != 2 {
-				fmt.Println("Invalid port map")
-				return
-			}
-			_, err := strconv.Atoi(split[0])
+			hostIP, hostPort, containerPort, err := parsePortSpec(ports)
 			if err != nil {
-				fmt.Printf("Port provided is not a valid number %s", split[0])
+				fmt.Println(err)
 				return
 			}
-			containerPort, err := strconv.Atoi(split[1])
-			if err != nil {
-				fmt.Printf("Port provided is not a valid number %s", split[1])
-				return
+			pm, ok := byHostIP[hostIP]
+			if !ok {
+				pm = forward.NewPortMappings()
+				pm.Protocol = forwards.Protocol
+				pm.HostIP = hostIP
+				hostIPs = append(hostIPs, hostIP)
 			}
-			forwards.Ports[split[0]] = containerPort
+			pm.Ports[hostPort] = containerPort
+			byHostIP[hostIP] = pm
+		}
+		for _, hostIP := range hostIPs {
+			config.Forwards[container] = append(config.Forwards[container], byHostIP[hostIP])
 		}
-		config.Forwards[container] = []forward.PortMappings{forwards}
 	} else {
 		var err error
 		config, err = forward.LoadYAMLConfig(configFile)
@@ -73,18 +89,29 @@ func main() {
 			fmt.Println(err)
 			return
 		}
+		fromConfigFile = true
 	}
 	forwarder, err := forward.NewForwarder(config)
 	if err != nil {
 		fmt.Println("Unable to create forwarding client", err)
 		return
 	}
+	if fromConfigFile {
+		forwarder.SetConfigPath(configFile)
+	}
 
 	if daemonize {
 		err := forwarder.Forward()
 		if err != nil {
 			fmt.Println("Error with initial forwarding of ports ", err)
 		}
+		if apiSocket != "" {
+			go func() {
+				if err := forwarder.Serve(apiSocket); err != nil {
+					fmt.Println("API server stopped", err)
+				}
+			}()
+		}
 		forwarder.Watch()
 	} else if enable {
 		err := forwarder.Forward()
@@ -101,3 +128,36 @@ func main() {
 	}
 
 }
+
+// parsePortSpec splits a single entry from --ports, e.g. "8080:80" or
+// "127.0.0.1:8080:80" or "[::1]:8080:80", into its optional bind address, host port and
+// container port
+func parsePortSpec(spec string) (hostIP, hostPort string, containerPort int, err error) {
+	idx := strings.LastIndex(spec, ":")
+	if idx == -1 {
+		return "", "", 0, fmt.Errorf("Invalid port map %s", spec)
+	}
+	containerPortStr := spec[idx+1:]
+	rest := spec[:idx]
+
+	idx = strings.LastIndex(rest, ":")
+	if idx == -1 {
+		hostPort = rest
+	} else {
+		hostIP = strings.TrimSuffix(strings.TrimPrefix(rest[:idx], "["), "]")
+		hostPort = rest[idx+1:]
+	}
+
+	// hostPort may also be "0" (pick any free port) or an "N-M" range - leave those to
+	// forward.Config.Validate, which already knows how to parse them.
+	if !strings.Contains(hostPort, "-") {
+		if _, err := strconv.Atoi(hostPort); err != nil {
+			return "", "", 0, fmt.Errorf("Port provided is not a valid number %s", hostPort)
+		}
+	}
+	containerPort, err = strconv.Atoi(containerPortStr)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("Port provided is not a valid number %s", containerPortStr)
+	}
+	return hostIP, hostPort, containerPort, nil
+}